@@ -0,0 +1,129 @@
+package handlers
+
+import "strings"
+
+// gsm7Chars is the GSM 03.38 default alphabet in septet order, without the 0x1B escape code
+var gsm7Chars = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// gsm7ExtChars is the GSM 03.38 extension table, each of which is escaped with an
+// extra septet (0x1B) when encoded so costs two septets instead of one
+var gsm7ExtChars = "^{}\\[~]|€"
+
+// IsGSM7 returns whether the passed in text can be represented entirely with the
+// GSM 03.38 default alphabet and extension table
+func IsGSM7(text string) bool {
+	for _, c := range text {
+		if !strings.ContainsRune(gsm7Chars, c) && !strings.ContainsRune(gsm7ExtChars, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// GSM7Septets returns the number of septets needed to encode the passed in text as
+// GSM7, counting extension table characters as two septets each
+func GSM7Septets(text string) int {
+	count := 0
+	for _, c := range text {
+		if strings.ContainsRune(gsm7ExtChars, c) {
+			count += 2
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+// the number of septets per part when a GSM7 message doesn't / does need to be split
+const maxGSM7SinglePart = 160
+const maxGSM7MultiPart = 153
+
+// the number of UTF-16 code units per part when a UCS2 message doesn't / does need to be split
+const maxUCS2SinglePart = 70
+const maxUCS2MultiPart = 67
+
+// SplitGSM7 splits text into GSM7-encodable parts, each of which fits within a single
+// SMS segment (160 septets) or, if the text doesn't fit in one segment, within the
+// 153 septets left over once the 6-octet (7 septet) concatenation UDH is accounted for
+func SplitGSM7(text string) []string {
+	if GSM7Septets(text) <= maxGSM7SinglePart {
+		return []string{text}
+	}
+	return splitBySeptets(text, maxGSM7MultiPart)
+}
+
+// SplitUCS2 splits text into UCS2-encodable parts, each of which fits within a single
+// SMS segment (70 UTF-16 code units) or, if the text doesn't fit in one segment, within
+// the 67 code units left over once the 6-octet concatenation UDH is accounted for
+func SplitUCS2(text string) []string {
+	if utf16Len(text) <= maxUCS2SinglePart {
+		return []string{text}
+	}
+	return splitByUTF16Units(text, maxUCS2MultiPart)
+}
+
+// splitBySeptets breaks text into parts of at most maxSeptets septets each, never
+// splitting an extension table character (worth two septets) across parts
+func splitBySeptets(text string, maxSeptets int) []string {
+	var parts []string
+	var current strings.Builder
+	septets := 0
+
+	for _, c := range text {
+		width := 1
+		if strings.ContainsRune(gsm7ExtChars, c) {
+			width = 2
+		}
+		if septets+width > maxSeptets {
+			parts = append(parts, current.String())
+			current.Reset()
+			septets = 0
+		}
+		current.WriteRune(c)
+		septets += width
+	}
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
+
+// utf16Len returns the number of UTF-16 code units needed to represent text, which is
+// what UCS2 segment limits are measured in (runes outside the BMP take two code units)
+func utf16Len(text string) int {
+	count := 0
+	for _, c := range text {
+		if c > 0xFFFF {
+			count += 2
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+// splitByUTF16Units breaks text into parts of at most maxUnits UTF-16 code units each,
+// never splitting a surrogate pair across parts
+func splitByUTF16Units(text string, maxUnits int) []string {
+	var parts []string
+	var current strings.Builder
+	units := 0
+
+	for _, c := range text {
+		width := 1
+		if c > 0xFFFF {
+			width = 2
+		}
+		if units+width > maxUnits {
+			parts = append(parts, current.String())
+			current.Reset()
+			units = 0
+		}
+		current.WriteRune(c)
+		units += width
+	}
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
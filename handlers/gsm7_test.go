@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsGSM7(t *testing.T) {
+	assert.True(t, IsGSM7("Hello World"))
+	assert.True(t, IsGSM7("Is this GSM007 encoded? {}[]~|^€"))
+	assert.False(t, IsGSM7("మీరు ఎలా ఉన్నారు"))
+	assert.False(t, IsGSM7("😃"))
+}
+
+func TestGSM7Septets(t *testing.T) {
+	assert.Equal(t, 11, GSM7Septets("Hello World"))
+	assert.Equal(t, 2, GSM7Septets("^"))
+	assert.Equal(t, 4, GSM7Septets("a^b"))
+}
+
+func TestSplitGSM7(t *testing.T) {
+	assert.Equal(t, []string{"Hello World"}, SplitGSM7("Hello World"))
+
+	long := strings.Repeat("a", 200)
+	parts := SplitGSM7(long)
+	assert.Equal(t, 2, len(parts))
+	assert.Equal(t, 153, len(parts[0]))
+	assert.Equal(t, 47, len(parts[1]))
+}
+
+func TestSplitUCS2(t *testing.T) {
+	assert.Equal(t, []string{"Hello"}, SplitUCS2("Hello"))
+
+	long := strings.Repeat("日", 140)
+	parts := SplitUCS2(long)
+	assert.Equal(t, 3, len(parts))
+	assert.Equal(t, 67, len([]rune(parts[0])))
+}
@@ -1,8 +1,14 @@
 package highconnection
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"time"
@@ -13,6 +19,38 @@ import (
 	"github.com/nyaruka/gocommon/urns"
 )
 
+// datacoding values as understood by the High Connection API
+const (
+	dataCodingGSM7 = "0"
+	dataCodingUCS2 = "8"
+)
+
+// configSignatureHeader is the channel config key that, when set to any non-empty
+// value, makes the handler verify an HMAC-SHA256 signature of the request read from
+// the header named by configAuthHeader; its value is not used as a header name. If
+// unset but courier.ConfigSecret is set, the handler falls back to comparing that
+// header's raw value against the secret (a "shared token" mode for providers that
+// can't sign requests).
+const configSignatureHeader = "signature_header"
+
+// configAuthHeader is the channel config key naming the HTTP header carrying the
+// signature or shared token. Defaults to "X-HX-Signature" if unset.
+const configAuthHeader = "auth_header"
+
+const defaultAuthHeader = "X-HX-Signature"
+
+// channel config keys controlling the per-channel send rate limit, in messages per
+// second and the burst size of the token bucket
+const (
+	configRateLimitTPS   = "rate_limit_tps"
+	configRateLimitBurst = "rate_limit_burst"
+)
+
+const (
+	defaultRateLimitTPS   = 10
+	defaultRateLimitBurst = 10
+)
+
 /*
 GET /handlers/hcnx/status/uuid?push_id=1164711372&status=6&to=%2B33611441111&ret_id=19128317&text=Msg
 
@@ -21,7 +59,6 @@ ID=1164708294&FROM=%2B33644961111&TO=36105&MESSAGE=Msg&VALIDITY_DATE=2017-05-03T
 */
 
 var sendURL = "https://highpushfastapi-v2.hcnx.eu/api"
-var maxMsgLength = 1500
 
 func init() {
 	courier.RegisterHandler(newHandler())
@@ -65,6 +102,10 @@ type moMsg struct {
 
 // ReceiveMessage is our HTTP handler function for incoming messages
 func (h *handler) ReceiveMessage(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	if err := verifyWebhookAuth(channel, r); err != nil {
+		return nil, writeAndLogUnauthorized(w, r, channel, err)
+	}
+
 	hxRequest := &moMsg{}
 	err := handlers.DecodeAndValidateForm(hxRequest, r)
 	if err != nil {
@@ -113,6 +154,10 @@ var statusMapping = map[int]courier.MsgStatusValue{
 
 // StatusMessage is our HTTP handler function for status updates
 func (h *handler) StatusMessage(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	if err := verifyWebhookAuth(channel, r); err != nil {
+		return nil, writeAndLogUnauthorized(w, r, channel, err)
+	}
+
 	hxRequest := &moStatus{}
 	err := handlers.DecodeAndValidateForm(hxRequest, r)
 	if err != nil {
@@ -155,9 +200,27 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 	statusURL := fmt.Sprintf("https://%s%s%s/status", callbackDomain, "/c/hx/", msg.Channel().UUID())
 	receiveURL := fmt.Sprintf("https://%s%s%s/receive", callbackDomain, "/c/hx/", msg.Channel().UUID())
 
+	text := handlers.GetTextAndAttachments(msg)
+
+	var dataCoding string
+	var parts []string
+	if handlers.IsGSM7(text) {
+		dataCoding = dataCodingGSM7
+		parts = handlers.SplitGSM7(text)
+	} else {
+		dataCoding = dataCodingUCS2
+		parts = handlers.SplitUCS2(text)
+	}
+
+	// reference used to tie together the parts of a multi-part message on the handset
+	ref := byte(msg.ID().Int64() % 256)
+
+	rateLimitKey := msg.Channel().UUID().String()
+	rateLimitTPS := float64(msg.Channel().IntConfigForKey(configRateLimitTPS, defaultRateLimitTPS))
+	rateLimitBurst := float64(msg.Channel().IntConfigForKey(configRateLimitBurst, defaultRateLimitBurst))
+
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
-	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
-	for _, part := range parts {
+	for i, part := range parts {
 
 		form := url.Values{
 			"accountid":  []string{username},
@@ -165,22 +228,37 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 			"text":       []string{part},
 			"to":         []string{msg.URN().Path()},
 			"ret_id":     []string{msg.ID().String()},
-			"datacoding": []string{"8"},
+			"datacoding": []string{dataCoding},
 			"userdata":   []string{"textit"},
 			"ret_url":    []string{statusURL},
 			"ret_mo_url": []string{receiveURL},
 		}
 
+		// if this is a multi-part message, include the concatenation UDH so handsets
+		// reassemble the parts in the right order
+		if len(parts) > 1 {
+			form["udh"] = []string{concatUDH(ref, i+1, len(parts))}
+		}
+
 		msgURL, _ := url.Parse(sendURL)
 		msgURL.RawQuery = form.Encode()
 
-		req, err := http.NewRequest(http.MethodPost, msgURL.String(), nil)
-		rr, err := utils.MakeHTTPRequest(req)
-
-		// record our status and log
-		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
-		status.AddLog(log)
+		_, err := handlers.SendWithRetry(ctx, func() (*http.Request, error) {
+			// wait for a rate limit token before every attempt, including retries, so a
+			// string of 5xx/429 responses can't be used to exceed the channel's TPS
+			if err := handlers.SendRateLimiter.Wait(ctx, rateLimitKey, rateLimitBurst, rateLimitTPS); err != nil {
+				return nil, err
+			}
+			return http.NewRequest(http.MethodPost, msgURL.String(), nil)
+		}, handlers.DefaultRetryConfig, func(rr *utils.RequestResponse, attemptErr error) {
+			log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", attemptErr)
+			status.AddLog(log)
+		})
+
+		// this part failed even after retrying, mark the whole message errored and stop;
+		// any earlier parts that did succeed keep their "Message Sent" logs above
 		if err != nil {
+			status.SetStatus(courier.MsgErrored)
 			return status, nil
 		}
 
@@ -190,3 +268,65 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 
 	return status, nil
 }
+
+// verifyWebhookAuth checks the inbound request against the channel's configured
+// secret, if any. With no secret configured, auth is disabled for backwards
+// compatibility. With a secret and configSignatureHeader set, it verifies an
+// HMAC-SHA256 over the raw request body (or, for GETs, the raw query string).
+// With a secret but no configSignatureHeader, it falls back to comparing the auth
+// header's value directly against the secret, for providers that can't sign.
+func verifyWebhookAuth(channel courier.Channel, r *http.Request) error {
+	secret := channel.StringConfigForKey(courier.ConfigSecret, "")
+	if secret == "" {
+		return nil
+	}
+
+	authHeader := channel.StringConfigForKey(configAuthHeader, defaultAuthHeader)
+	got := r.Header.Get(authHeader)
+	if got == "" {
+		return fmt.Errorf("missing %s header", authHeader)
+	}
+
+	if channel.StringConfigForKey(configSignatureHeader, "") == "" {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+			return fmt.Errorf("invalid auth token")
+		}
+		return nil
+	}
+
+	var signed []byte
+	if r.Method == http.MethodGet {
+		signed = []byte(r.URL.RawQuery)
+	} else {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return fmt.Errorf("error reading request body: %w", err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		signed = body
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signed)
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(got)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// writeAndLogUnauthorized writes a 401 response for a failed webhook authentication
+// check and returns an error describing why, for the caller to log
+func writeAndLogUnauthorized(w http.ResponseWriter, r *http.Request, channel courier.Channel, err error) error {
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(err.Error()))
+	return err
+}
+
+// concatUDH builds the hex-encoded User Data Header used to concatenate the parts of a
+// multi-part SMS: header length 05, IE 00 (concatenated short messages, 8-bit reference), length 03,
+// message reference, total parts, this part's sequence number (1-based)
+func concatUDH(ref byte, part, total int) string {
+	return fmt.Sprintf("050003%02X%02X%02X", ref, byte(total), byte(part))
+}
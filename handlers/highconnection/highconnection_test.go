@@ -0,0 +1,88 @@
+package highconnection
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/nyaruka/courier"
+	. "github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/test"
+)
+
+var testChannels = []courier.Channel{
+	test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "HX", "2020", "US", nil),
+	test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "HX", "2020", "US", map[string]interface{}{
+		"secret": "sesame",
+	}),
+	test.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "HX", "2020", "US", map[string]interface{}{
+		"secret":           "sesame",
+		"signature_header": "X-HX-Signature",
+	}),
+}
+
+var (
+	receiveURL = "/c/hx/8eb23e93-5ecb-45ba-b726-3b064e0c56ab/receive"
+
+	receiveValidMessage = receiveURL + "?FROM=%2B33610346460&TO=34250&MESSAGE=Hello+World&RECEPTION_DATE=2017-01-01T00:00:00"
+)
+
+func sign(secret, query string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(query))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var noAuthCases = []ChannelHandleTestCase{
+	{Label: "Receive Valid, No Auth Configured", URL: receiveValidMessage, Status: 200, Response: "Message Accepted"},
+}
+
+var tokenCases = []ChannelHandleTestCase{
+	{Label: "Receive Missing Token", URL: receiveValidMessage, Status: 401, Response: "missing X-HX-Signature header"},
+	{
+		Label:   "Receive Wrong Token",
+		URL:     receiveValidMessage,
+		Headers: map[string]string{"X-HX-Signature": "wrong"},
+		Status:  401, Response: "invalid auth token",
+	},
+	{
+		Label:   "Receive Valid Token",
+		URL:     receiveValidMessage,
+		Headers: map[string]string{"X-HX-Signature": "sesame"},
+		Status:  200, Response: "Message Accepted",
+	},
+}
+
+func TestReceiveNoAuthConfigured(t *testing.T) {
+	noAuthChannel := []courier.Channel{testChannels[0]}
+	RunChannelTestCases(t, noAuthChannel, newHandler(), noAuthCases)
+}
+
+func TestReceiveAuth(t *testing.T) {
+	tokenChannel := []courier.Channel{testChannels[1]}
+	RunChannelTestCases(t, tokenChannel, newHandler(), tokenCases)
+}
+
+func TestReceiveHMAC(t *testing.T) {
+	hmacChannel := []courier.Channel{testChannels[2]}
+
+	query := receiveValidMessage[len(receiveURL)+1:]
+	validSig := sign("sesame", query)
+
+	hmacCases := []ChannelHandleTestCase{
+		{
+			Label:   "Receive Valid Signature",
+			URL:     receiveValidMessage,
+			Headers: map[string]string{"X-HX-Signature": validSig},
+			Status:  200, Response: "Message Accepted",
+		},
+		{
+			Label:   "Receive Tampered Signature",
+			URL:     receiveValidMessage,
+			Headers: map[string]string{"X-HX-Signature": sign("sesame", query+"tampered")},
+			Status:  401, Response: "invalid signature",
+		},
+	}
+	RunChannelTestCases(t, hmacChannel, newHandler(), hmacCases)
+}
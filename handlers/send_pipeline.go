@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+)
+
+// RetryConfig controls the retry/backoff behavior of SendWithRetry
+type RetryConfig struct {
+	MaxRetries int           // number of retries after the initial attempt
+	BaseDelay  time.Duration // backoff base, doubled on every retry
+	MaxDelay   time.Duration // backoff is capped at this, before jitter
+}
+
+// DefaultRetryConfig is a reasonable default for handlers that don't need to tune
+// retry behavior: 3 retries, starting at 500ms and capped at 30s
+var DefaultRetryConfig = RetryConfig{MaxRetries: 3, BaseDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second}
+
+// SendWithRetry sends an HTTP request built by reqFn (called fresh for every attempt,
+// since a request can only be used once), retrying 5xx responses and transport errors
+// with jittered exponential backoff up to cfg.MaxRetries times. A 429 response honors
+// its Retry-After header as the backoff for that attempt, if present, instead of the
+// computed jittered delay. onAttempt is called after every attempt (including the
+// final one) so callers can record each try, e.g. via status.AddLog.
+func SendWithRetry(ctx context.Context, reqFn func() (*http.Request, error), cfg RetryConfig, onAttempt func(*utils.RequestResponse, error)) (*utils.RequestResponse, error) {
+	var rr *utils.RequestResponse
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		req, buildErr := reqFn()
+		if buildErr != nil {
+			return nil, buildErr
+		}
+
+		rr, err = utils.MakeHTTPRequest(req)
+		onAttempt(rr, err)
+
+		// utils.MakeHTTPRequest returns a non-nil err for any non-2xx response, so we
+		// classify retryability from the status code itself rather than err: only a
+		// connection failure (StatusCode left at its zero value since there was no
+		// response), a 5xx, or a 429 are worth retrying. A permanent failure like a 4xx
+		// should fail on the first attempt.
+		retryable := rr == nil || rr.StatusCode == 0 || rr.StatusCode >= 500 || rr.StatusCode == http.StatusTooManyRequests
+		if !retryable {
+			return rr, err
+		}
+
+		if attempt >= cfg.MaxRetries {
+			break
+		}
+
+		delay := jitteredBackoff(cfg, attempt)
+		if rr != nil && rr.StatusCode == http.StatusTooManyRequests {
+			if retryAfter := retryAfterDelay(rr); retryAfter > 0 {
+				delay = retryAfter
+			}
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return rr, ctx.Err()
+		}
+	}
+
+	if err == nil {
+		status := 0
+		if rr != nil {
+			status = rr.StatusCode
+		}
+		err = fmt.Errorf("giving up after %d attempts, last status was %d", cfg.MaxRetries+1, status)
+	}
+	return rr, err
+}
+
+// jitteredBackoff returns the delay to use before the attempt following the given
+// (zero-indexed) attempt number: cfg.BaseDelay doubled per attempt, capped at
+// cfg.MaxDelay, then randomized to within +/-25% to avoid thundering-herd retries
+func jitteredBackoff(cfg RetryConfig, attempt int) time.Duration {
+	delay := cfg.BaseDelay * time.Duration(math.Pow(2, float64(attempt)))
+	if delay > cfg.MaxDelay {
+		delay = cfg.MaxDelay
+	}
+	jitter := 0.75 + rand.Float64()*0.5
+	return time.Duration(float64(delay) * jitter)
+}
+
+// retryAfterDelay pulls a Retry-After value (delay-seconds or HTTP-date form) out of a
+// 429 response's raw dump, returning 0 if absent or unparseable
+func retryAfterDelay(rr *utils.RequestResponse) time.Duration {
+	value := headerFromDump(rr.Response, "Retry-After")
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// headerFromDump scans a raw HTTP dump (as produced for utils.RequestResponse.Response)
+// for the given header and returns its value, or "" if not present
+func headerFromDump(dump, header string) string {
+	for _, line := range strings.Split(dump, "\r\n") {
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), header) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// RateLimiter enforces a token-bucket rate limit per key, e.g. a channel UUID. The
+// zero value is not usable; construct with NewRateLimiter
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens    float64
+	capacity  float64
+	perSecond float64
+	updatedAt time.Time
+}
+
+// NewRateLimiter creates an empty RateLimiter
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// SendRateLimiter is the shared limiter used by handlers sending through SendWithRetry
+var SendRateLimiter = NewRateLimiter()
+
+// Wait blocks, respecting ctx, until a token is available in the bucket for key,
+// creating that bucket on first use with the given capacity and perSecond refill rate.
+// A non-positive capacity or perSecond disables limiting entirely rather than blocking
+// forever or dividing by zero.
+func (rl *RateLimiter) Wait(ctx context.Context, key string, capacity, perSecond float64) error {
+	if capacity <= 0 || perSecond <= 0 {
+		return nil
+	}
+	for {
+		wait := rl.reserve(key, capacity, perSecond)
+		if wait <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (rl *RateLimiter) reserve(key string, capacity, perSecond float64) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, capacity: capacity, perSecond: perSecond, updatedAt: time.Now()}
+		rl.buckets[key] = b
+	}
+
+	now := time.Now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.updatedAt).Seconds()*b.perSecond)
+	b.updatedAt = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.perSecond * float64(time.Second))
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJitteredBackoff(t *testing.T) {
+	cfg := RetryConfig{MaxRetries: 5, BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		delay := jitteredBackoff(cfg, attempt)
+		assert.True(t, delay > 0)
+		assert.True(t, delay <= cfg.MaxDelay+cfg.MaxDelay/2)
+	}
+}
+
+func TestHeaderFromDump(t *testing.T) {
+	dump := "HTTP/1.1 429 Too Many Requests\r\nRetry-After: 2\r\nContent-Type: text/plain\r\n\r\nslow down"
+	assert.Equal(t, "2", headerFromDump(dump, "Retry-After"))
+	assert.Equal(t, "text/plain", headerFromDump(dump, "content-type"))
+	assert.Equal(t, "", headerFromDump(dump, "X-Missing"))
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	rl := NewRateLimiter()
+	ctx := context.Background()
+
+	// burst of 2 tokens, refilling at 100/s, so the first two calls are immediate and
+	// the third should block briefly for a token to refill
+	assert.NoError(t, rl.Wait(ctx, "channel-1", 2, 100))
+	assert.NoError(t, rl.Wait(ctx, "channel-1", 2, 100))
+
+	start := time.Now()
+	assert.NoError(t, rl.Wait(ctx, "channel-1", 2, 100))
+	assert.True(t, time.Since(start) < time.Second)
+
+	// a different key has its own independent bucket
+	assert.NoError(t, rl.Wait(ctx, "channel-2", 2, 100))
+}
+
+func TestSendWithRetrySucceedsAfter500(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := RetryConfig{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	var attempts int32
+	rr, err := SendWithRetry(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, server.URL, nil)
+	}, cfg, func(*utils.RequestResponse, error) {
+		atomic.AddInt32(&attempts, 1)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rr.StatusCode)
+	assert.Equal(t, int32(3), attempts)
+}
+
+func TestSendWithRetryRetriesConnectionFailure(t *testing.T) {
+	// bind then immediately close a listener so its address is refused on connect,
+	// giving us a real (fast) network failure instead of a hanging timeout
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	unreachableURL := "http://" + listener.Addr().String()
+	listener.Close()
+
+	cfg := RetryConfig{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	var attempts int32
+	rr, sendErr := SendWithRetry(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, unreachableURL, nil)
+	}, cfg, func(*utils.RequestResponse, error) {
+		atomic.AddInt32(&attempts, 1)
+	})
+
+	assert.Error(t, sendErr)
+	assert.Equal(t, 0, rr.StatusCode)
+	assert.Equal(t, int32(3), attempts) // initial attempt + 2 retries
+}
+
+func TestSendWithRetryHonorsRetryAfter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// BaseDelay is deliberately much larger than the Retry-After value, so honoring the
+	// shorter header (rather than the computed jittered backoff) is what keeps this fast
+	cfg := RetryConfig{MaxRetries: 1, BaseDelay: 5 * time.Second, MaxDelay: 10 * time.Second}
+
+	start := time.Now()
+	rr, err := SendWithRetry(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, server.URL, nil)
+	}, cfg, func(*utils.RequestResponse, error) {})
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rr.StatusCode)
+	assert.True(t, time.Since(start) < 2*time.Second, "should have waited ~1s from Retry-After, not the 5s base backoff")
+}
+
+func TestSendWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	cfg := RetryConfig{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	var attempts int32
+	rr, err := SendWithRetry(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, server.URL, nil)
+	}, cfg, func(*utils.RequestResponse, error) {
+		atomic.AddInt32(&attempts, 1)
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusInternalServerError, rr.StatusCode)
+	assert.Equal(t, int32(3), attempts) // initial attempt + 2 retries
+}
+
+func TestSendWithRetryFailsFastOn4xx(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	cfg := RetryConfig{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	var attempts int32
+	rr, err := SendWithRetry(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, server.URL, nil)
+	}, cfg, func(*utils.RequestResponse, error) {
+		atomic.AddInt32(&attempts, 1)
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, rr.StatusCode)
+	assert.Equal(t, int32(1), attempts) // no retries for a permanent 4xx
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	rl := NewRateLimiter()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// bucket is empty once its only token is consumed, so Wait must block, and should
+	// return ctx.Err() immediately
+	rl.reserve("channel-3", 1, 1) // consume the only token
+	assert.Error(t, rl.Wait(ctx, "channel-3", 1, 1))
+}